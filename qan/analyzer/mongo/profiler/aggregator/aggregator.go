@@ -1,10 +1,15 @@
 package aggregator
 
 import (
+	"crypto/md5"
+	"fmt"
+	"path"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/axiomhq/hyperloglog"
 	"github.com/percona/go-mysql/event"
 	"github.com/percona/percona-toolkit/src/go/mongolib/fingerprinter"
 	"github.com/percona/percona-toolkit/src/go/mongolib/proto"
@@ -12,112 +17,773 @@ import (
 	pc "github.com/percona/pmm/proto/config"
 	"github.com/percona/pmm/proto/qan"
 	"github.com/percona/qan-agent/qan/analyzer/report"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/mgo.v2/bson"
 )
 
+// Config is the aggregator's configuration. It embeds pc.QAN for the fields
+// that already live there (Interval, ExampleQueries, ...) and adds the
+// aggregator-specific knobs below, which haven't landed in that upstream
+// struct yet - keeping them here means this package doesn't depend on an
+// unreleased change to a module it doesn't own.
+type Config struct {
+	pc.QAN
+
+	// MaxGroups bounds the number of query classes tracked per interval.
+	// Once it's reached, further documents are folded into the overflow class.
+	MaxGroups int
+
+	// PerDatabaseInterval overrides the aggregation interval (in seconds) for
+	// specific databases or glob patterns over database names.
+	PerDatabaseInterval map[string]int
+
+	// PastIntervals is how many completed-but-unreported intervals are kept
+	// behind the current one, to give late-arriving docs somewhere to land.
+	PastIntervals int
+
+	// HWMarkTTL is how long, in seconds, a past interval stays open to late
+	// arrivals before it's finalized and evicted.
+	HWMarkTTL int
+
+	// Fingerprint configures how system.profile queries are fingerprinted.
+	Fingerprint FingerprintConfig
+}
+
+// FingerprintConfig configures the fingerprinter used to turn a query into
+// its class.
+type FingerprintConfig struct {
+	// KeyFilters are the query keys stripped before fingerprinting, e.g. so
+	// documents differing only in a filtered key collapse into one class.
+	KeyFilters []string
+
+	// MaxDepth bounds how many levels of documents/arrays, counting the query
+	// itself as the first, are kept before fingerprinting; anything deeper is
+	// collapsed. Zero means unlimited.
+	MaxDepth int
+
+	// Replacements mask or collapse parts of a rendered fingerprint, e.g. to
+	// keep PII-like literals out of reports.
+	Replacements map[string]string
+}
+
 const (
 	DefaultInterval       = 60 // in seconds
 	DefaultExampleQueries = true
+
+	// DefaultMaxGroups bounds the number of query classes tracked per interval.
+	// Once it's reached, further documents are folded into the overflow class.
+	DefaultMaxGroups = 10000
+
+	// DefaultPastIntervals is how many completed-but-unreported intervals are
+	// kept behind the current one, to give late-arriving docs somewhere to land.
+	DefaultPastIntervals = 2
+
+	// DefaultHWMarkTTLMultiplier sets how long a past interval stays open,
+	// expressed as a multiple of the aggregation interval.
+	DefaultHWMarkTTLMultiplier = 4
+
+	overflowFingerprint = "_other"
 )
 
+// overflowID is the ID of the synthetic overflow class, computed the same
+// way go-mysql/event derives class IDs from a fingerprint.
+var overflowID = fmt.Sprintf("%x", md5.Sum([]byte(overflowFingerprint)))
+
+// Option customizes an *Aggregator built by New.
+type Option func(*options)
+
+type options struct {
+	registerer    prometheus.Registerer
+	fingerprinter fingerprinter.Fingerprinter
+}
+
+// WithRegisterer registers the aggregator's Prometheus metrics with reg.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registerer = reg
+	}
+}
+
+// WithFingerprinter overrides the fingerprinter.Fingerprinter built from
+// config.Fingerprint, so downstream binaries can inject their own
+// implementation without forking this package.
+func WithFingerprinter(fp fingerprinter.Fingerprinter) Option {
+	return func(o *options) {
+		o.fingerprinter = fp
+	}
+}
+
 // New returns configured *Aggregator
-func New(timeStart time.Time, config pc.QAN) *Aggregator {
+func New(timeStart time.Time, config Config, opts ...Option) *Aggregator {
 	// verify config
 	if config.Interval == 0 {
 		config.Interval = DefaultInterval
 		config.ExampleQueries = DefaultExampleQueries
 	}
+	if config.MaxGroups == 0 {
+		config.MaxGroups = DefaultMaxGroups
+	}
+
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	fp := o.fingerprinter
+	if fp == nil {
+		keyFilters := config.Fingerprint.KeyFilters
+		if len(keyFilters) == 0 {
+			keyFilters = fingerprinter.DEFAULT_KEY_FILTERS
+		}
+		fp = fingerprinter.NewFingerprinter(keyFilters)
+	}
 
-	aggregator := &Aggregator{
-		config: config,
+	return &Aggregator{
+		config:       config,
+		D:            time.Duration(config.Interval) * time.Second,
+		timeStart:    timeStart,
+		dbs:          make(map[string]*dbAggregator),
+		metrics:      newMetrics(o.registerer),
+		fp:           fp,
+		replacements: compileReplacements(config.Fingerprint.Replacements),
 	}
+}
 
-	// create duration from interval
-	aggregator.D = time.Duration(config.Interval) * time.Second
+// fingerprintReplacement masks or collapses a portion of a rendered
+// fingerprint, e.g. to keep PII-like literals out of reports.
+type fingerprintReplacement struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
 
-	// create mongolib stats
-	fp := fingerprinter.NewFingerprinter(fingerprinter.DEFAULT_KEY_FILTERS)
-	aggregator.stats = stats.New(fp)
+// compileReplacements precompiles config.Fingerprint.Replacements once so
+// createResult doesn't recompile a regexp per query class per interval.
+// Invalid patterns are skipped rather than failing aggregation.
+func compileReplacements(replacements map[string]string) []fingerprintReplacement {
+	compiled := make([]fingerprintReplacement, 0, len(replacements))
+	for pattern, replacement := range replacements {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			continue
+		}
+		compiled = append(compiled, fingerprintReplacement{pattern: re, replacement: replacement})
+	}
+
+	return compiled
+}
 
-	// create new interval
-	aggregator.newInterval(timeStart)
+func applyReplacements(fingerprint string, replacements []fingerprintReplacement) string {
+	for _, r := range replacements {
+		fingerprint = r.pattern.ReplaceAllString(fingerprint, r.replacement)
+	}
 
-	return aggregator
+	return fingerprint
 }
 
-// Aggregator aggregates system.profile document
+// Aggregator routes system.profile documents to a per-database sub-aggregator
+// so each database can be bucketed into its own aggregation interval.
 type Aggregator struct {
 	// dependencies
-	config pc.QAN
+	config Config
+
+	// D is the default interval duration, used for databases without an override
+	D time.Duration
 
-	// interval
+	// timeStart is only used to answer TimeStart before any database has been seen
 	timeStart time.Time
-	timeEnd   time.Time
-	D         time.Duration
-	stats     *stats.Stats
+
+	dbs map[string]*dbAggregator
+
+	metrics *Metrics
+
+	// fp is shared by every database's sub-aggregator
+	fp fingerprinter.Fingerprinter
+	// replacements mask or collapse parts of a rendered fingerprint, e.g. PII
+	replacements []fingerprintReplacement
 
 	// make it safe to use from different threads
 	sync.Mutex
 }
 
-// Add aggregates new system.profile document and returns report if it's ready
+// Add aggregates new system.profile document, dispatching it to the sub-aggregator
+// for its database, and returns a report if anything became ready to send
 func (self *Aggregator) Add(doc proto.SystemProfile) (*qan.Report, error) {
 	self.Lock()
 	defer self.Unlock()
 
-	ts := doc.Ts.UTC()
+	self.metrics.DocsIngestedTotal.Inc()
 
-	// skip old metrics
-	if ts.Before(self.timeStart) {
-		return nil, nil
+	db := self.dbAggregatorFor(doc.Ns, doc.Ts.UTC())
+
+	result, start, end, err := db.add(doc)
+	if result == nil {
+		return nil, err
+	}
+
+	self.metrics.ReportsEmittedTotal.Inc()
+	return report.MakeReport(self.config.QAN, start, end, nil, result), err
+}
+
+// dbAggregatorFor returns the sub-aggregator for doc's database, creating it
+// (using that database's configured interval) if this is the first time it's seen
+func (self *Aggregator) dbAggregatorFor(ns string, ts time.Time) *dbAggregator {
+	name := dbName(ns)
+
+	db, ok := self.dbs[name]
+	if !ok {
+		db = newDBAggregator(ts, self.config, self.intervalFor(name), self.metrics, self.fp, self.replacements, name)
+		self.dbs[name] = db
+	}
+
+	return db
+}
+
+// intervalFor returns the aggregation interval configured for db, falling back
+// to config.PerDatabaseInterval glob patterns and finally the global default
+func (self *Aggregator) intervalFor(db string) time.Duration {
+	if seconds, ok := self.config.PerDatabaseInterval[db]; ok {
+		return time.Duration(seconds) * time.Second
+	}
+
+	for pattern, seconds := range self.config.PerDatabaseInterval {
+		if ok, _ := path.Match(pattern, db); ok {
+			return time.Duration(seconds) * time.Second
+		}
 	}
 
-	return self.interval(ts), self.stats.Add(doc)
+	return self.D
+}
+
+// dbName returns the database part of a "db.collection" namespace
+func dbName(ns string) string {
+	s := strings.SplitN(ns, ".", 2)
+	return s[0]
 }
 
-// Report generates report for current interval and starts new one
+// Report flushes, for every database, each past interval still waiting out its
+// TTL and the current interval once it has ended, and returns them as a single
+// merged report. Within a database, classes come oldest interval first;
+// databases are taken in no particular order.
 func (self *Aggregator) Report() *qan.Report {
 	self.Lock()
 	defer self.Unlock()
 
-	return self.interval(time.Now())
-}
+	now := time.Now()
+	var pending []pendingResult
 
-// interval sets interval if necessary and returns *qan.Report for old interval if not empty
-func (self *Aggregator) interval(ts time.Time) *qan.Report {
-	// if time is before interval end then we are still in the same interval, nothing to do
-	if ts.Before(self.timeEnd) {
-		return nil
+	for _, db := range self.dbs {
+		result, start, end := db.report(now)
+		if result == nil {
+			continue
+		}
+		pending = append(pending, pendingResult{result: result, timeStart: start, timeEnd: end})
 	}
 
-	// create new interval
-	defer self.newInterval(ts)
-
-	// let's check if we have anything to send for current interval
-	if len(self.stats.Queries()) == 0 {
-		// if there are no queries then we don't create report #PMM-927
+	merged, start, end := mergeResults(pending)
+	if merged == nil {
 		return nil
 	}
 
-	// create result
-	result := self.createResult()
+	self.metrics.ReportsEmittedTotal.Inc()
+	return report.MakeReport(self.config.QAN, start, end, nil, merged)
+}
+
+// DroppedTooOld returns the number of documents that arrived too late to
+// land in any still-open interval, across all databases, so operators can tune the TTL
+func (self *Aggregator) DroppedTooOld() uint64 {
+	self.Lock()
+	defer self.Unlock()
+
+	var total uint64
+	for _, db := range self.dbs {
+		total += db.droppedTooOld
+	}
 
-	// translate result into report and return it
-	return report.MakeReport(self.config, self.timeStart, self.timeEnd, nil, result)
+	return total
 }
 
-// TimeStart returns start time for current interval
+// TimeStart returns the earliest current interval's start time across all databases
 func (self *Aggregator) TimeStart() time.Time {
-	return self.timeStart
+	self.Lock()
+	defer self.Unlock()
+
+	if len(self.dbs) == 0 {
+		return self.timeStart
+	}
+
+	var min time.Time
+	for _, db := range self.dbs {
+		if min.IsZero() || db.timeStart.Before(min) {
+			min = db.timeStart
+		}
+	}
+
+	return min
 }
 
-// TimeEnd returns end time for current interval
+// TimeEnd returns the latest open interval's end time across all databases
 func (self *Aggregator) TimeEnd() time.Time {
-	return self.timeEnd
+	self.Lock()
+	defer self.Unlock()
+
+	var max time.Time
+	for _, db := range self.dbs {
+		if db.timeEnd.After(max) {
+			max = db.timeEnd
+		}
+	}
+
+	return max
 }
 
-func (self *Aggregator) newInterval(ts time.Time) {
-	// reset stats
-	self.stats.Reset()
+// pendingResult is a report.Result that's ready to go out, along with the
+// interval it covers, waiting to be merged with its siblings into one report
+type pendingResult struct {
+	result    *report.Result
+	timeStart time.Time
+	timeEnd   time.Time
+}
+
+// mergeResults combines pending results, in whatever order they're given,
+// into a single report.Result spanning their earliest start and latest end
+func mergeResults(pending []pendingResult) (*report.Result, time.Time, time.Time) {
+	if len(pending) == 0 {
+		return nil, time.Time{}, time.Time{}
+	}
+
+	merged := &report.Result{Global: event.NewClass("", "", false)}
+	var start, end time.Time
+	for _, p := range pending {
+		if start.IsZero() || p.timeStart.Before(start) {
+			start = p.timeStart
+		}
+		if p.timeEnd.After(end) {
+			end = p.timeEnd
+		}
+
+		merged.Class = append(merged.Class, p.result.Class...)
+		for _, class := range p.result.Class {
+			merged.Global.AddClass(class)
+		}
+	}
+
+	return merged, start, end
+}
+
+// Metrics are the aggregator's Prometheus instruments. New always builds one;
+// it's only actually registered when a prometheus.Registerer is passed to New.
+type Metrics struct {
+	DocsIngestedTotal    prometheus.Counter
+	DocsDroppedTotal     *prometheus.CounterVec
+	ReportsEmittedTotal  prometheus.Counter
+	IntervalBuildSeconds prometheus.Histogram
+	ReportClasses        prometheus.Histogram
+	ActiveClasses        *prometheus.GaugeVec
+}
+
+func newMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		DocsIngestedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "qan_mongo_docs_ingested_total",
+			Help: "Total number of system.profile documents ingested by the aggregator.",
+		}),
+		DocsDroppedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qan_mongo_docs_dropped_total",
+			Help: "Total number of system.profile documents that weren't aggregated into a normal query class.",
+		}, []string{"reason"}),
+		ReportsEmittedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "qan_mongo_reports_emitted_total",
+			Help: "Total number of QAN reports emitted by the aggregator.",
+		}),
+		IntervalBuildSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "qan_mongo_interval_build_seconds",
+			Help:    "Time spent turning a closed interval's stats into a report result.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		ReportClasses: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "qan_mongo_report_classes",
+			Help:    "Number of query classes in a single reported interval.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		ActiveClasses: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qan_mongo_active_classes",
+			Help: "Number of query classes currently tracked in the open interval.",
+		}, []string{"database"}),
+	}
+
+	if reg != nil {
+		reg.MustRegister(
+			m.DocsIngestedTotal,
+			m.DocsDroppedTotal,
+			m.ReportsEmittedTotal,
+			m.IntervalBuildSeconds,
+			m.ReportClasses,
+			m.ActiveClasses,
+		)
+	}
+
+	return m
+}
+
+// dbAggregator aggregates system.profile documents for a single database
+// over its own aggregation interval
+type dbAggregator struct {
+	config Config
+	D      time.Duration
+
+	// name is the database this sub-aggregator covers, used to label its
+	// per-database Prometheus metrics
+	name string
+
+	timeStart time.Time
+	timeEnd   time.Time
+	stats     *stats.Stats
+	metrics   *Metrics
+
+	// fp fingerprints documents for every interval this database opens
+	fp fingerprinter.Fingerprinter
+	// replacements mask or collapse parts of a rendered fingerprint, e.g. PII
+	replacements []fingerprintReplacement
+	// maxDepth bounds how many levels of nested documents/arrays are kept in a
+	// query before fingerprinting; zero means unlimited
+	maxDepth int
+
+	// overflow holds documents folded together once config.MaxGroups is reached
+	overflow overflowBucket
+
+	// past holds completed-but-unreported intervals, oldest first, so
+	// late-arriving docs still have somewhere to land until their TTL elapses
+	past []*pastInterval
+	// maxPast bounds how many completed intervals are kept behind the current one
+	maxPast int
+	// hwMarkTTL is how long a past interval stays open to late arrivals
+	hwMarkTTL time.Duration
+
+	// droppedTooOld counts docs that arrived after even the oldest past interval had closed
+	droppedTooOld uint64
+}
+
+// pastInterval is a completed aggregation interval that hasn't been reported
+// yet, kept around so documents arriving slightly out of order aren't dropped
+type pastInterval struct {
+	timeStart time.Time
+	timeEnd   time.Time
+	expiresAt time.Time
+	stats     *stats.Stats
+	overflow  overflowBucket
+}
+
+func newDBAggregator(timeStart time.Time, config Config, d time.Duration, metrics *Metrics, fp fingerprinter.Fingerprinter, replacements []fingerprintReplacement, name string) *dbAggregator {
+	maxPast := config.PastIntervals
+	if maxPast == 0 {
+		maxPast = DefaultPastIntervals
+	}
+
+	hwMarkTTL := time.Duration(config.HWMarkTTL) * time.Second
+	if hwMarkTTL == 0 {
+		hwMarkTTL = d * DefaultHWMarkTTLMultiplier
+	}
+
+	db := &dbAggregator{
+		config:       config,
+		D:            d,
+		name:         name,
+		maxPast:      maxPast,
+		hwMarkTTL:    hwMarkTTL,
+		metrics:      metrics,
+		fp:           fp,
+		replacements: replacements,
+		maxDepth:     config.Fingerprint.MaxDepth,
+	}
+	db.newInterval(timeStart)
+
+	return db
+}
+
+// overflowBucket approximates metrics for the documents that didn't fit
+// within config.MaxGroups query classes in the current interval.
+type overflowBucket struct {
+	count        uint64
+	queryTime    runningStat
+	bytesSent    runningStat
+	rowsSent     runningStat
+	rowsExamined runningStat
+	fingerprints *hyperloglog.Sketch
+	namespaces   *hyperloglog.Sketch
+}
+
+func newOverflowBucket() overflowBucket {
+	return overflowBucket{
+		fingerprints: hyperloglog.New14(),
+		namespaces:   hyperloglog.New14(),
+	}
+}
+
+// runningStat keeps enough state to reconstruct a stats.Statistics without
+// retaining every sample, which is what makes the overflow bucket O(1) per doc.
+type runningStat struct {
+	n   uint64
+	sum float64
+	min float64
+	max float64
+}
+
+func (r *runningStat) Add(v float64) {
+	if r.n == 0 || v < r.min {
+		r.min = v
+	}
+	if v > r.max {
+		r.max = v
+	}
+	r.sum += v
+	r.n++
+}
+
+// Statistics approximates Median/Pct95 with Avg since individual samples aren't kept.
+func (r *runningStat) Statistics() stats.Statistics {
+	var avg float64
+	if r.n > 0 {
+		avg = r.sum / float64(r.n)
+	}
+	return stats.Statistics{
+		Total:  r.sum,
+		Min:    r.min,
+		Max:    r.max,
+		Avg:    avg,
+		Median: avg,
+		Pct95:  avg,
+	}
+}
+
+// add aggregates doc into db's current interval. If doc arrived after the
+// current interval closed, it's routed to whichever still-open past interval
+// covers its timestamp instead of being dropped. Anything that became ready
+// to send while handling doc (an expired past interval, or the current
+// interval rolling over) is returned as a single merged result.
+func (self *dbAggregator) add(doc proto.SystemProfile) (*report.Result, time.Time, time.Time, error) {
+	if self.maxDepth > 0 {
+		doc.Query = truncateDepth(doc.Query, self.maxDepth)
+	}
+
+	ts := doc.Ts.UTC()
+
+	pending := self.rollOnAdd(ts)
+	merged, start, end := mergeResults(pending)
+
+	if ts.Before(self.timeStart) {
+		if !self.addToPast(doc, ts) {
+			self.droppedTooOld++
+			self.metrics.DocsDroppedTotal.WithLabelValues("old").Inc()
+		}
+		return merged, start, end, nil
+	}
+
+	// once we hit MaxGroups tracked classes, stop allocating new ones and fold
+	// only docs that would create another new class into the overflow class;
+	// docs matching an already-tracked class keep updating that class
+	if len(self.stats.Queries()) >= self.config.MaxGroups && !self.isTrackedClass(doc, self.stats) {
+		self.metrics.DocsDroppedTotal.WithLabelValues("overflow").Inc()
+		self.addOverflow(&self.overflow, doc)
+		self.metrics.ActiveClasses.WithLabelValues(self.name).Set(float64(len(self.stats.Queries())))
+		return merged, start, end, nil
+	}
+
+	err := self.stats.Add(doc)
+	self.metrics.ActiveClasses.WithLabelValues(self.name).Set(float64(len(self.stats.Queries())))
+	return merged, start, end, err
+}
+
+// isTrackedClass reports whether doc's fingerprint already has a class in
+// st, i.e. whether st.Add(doc) would update an existing class rather than
+// allocate a new one
+func (self *dbAggregator) isTrackedClass(doc proto.SystemProfile, st *stats.Stats) bool {
+	fingerprint, err := self.fp.Fingerprint(doc.Query)
+	if err != nil {
+		return false
+	}
+
+	_, tracked := st.Queries()[fingerprint]
+	return tracked
+}
+
+// addToPast routes doc into whichever past interval's window still covers ts,
+// applying the same MaxGroups/overflow cap that the current interval enforces
+// so a burst of late, high-cardinality traffic can't grow a past interval
+// without bound
+func (self *dbAggregator) addToPast(doc proto.SystemProfile, ts time.Time) bool {
+	for _, p := range self.past {
+		if !ts.Before(p.timeStart) && ts.Before(p.timeEnd) {
+			if len(p.stats.Queries()) >= self.config.MaxGroups && !self.isTrackedClass(doc, p.stats) {
+				self.metrics.DocsDroppedTotal.WithLabelValues("overflow").Inc()
+				self.addOverflow(&p.overflow, doc)
+				return true
+			}
+
+			p.stats.Add(doc)
+			return true
+		}
+	}
+
+	return false
+}
+
+// addOverflow folds doc into overflow, the overflow class for whichever
+// interval - current or past - doc landed in
+func (self *dbAggregator) addOverflow(overflow *overflowBucket, doc proto.SystemProfile) {
+	overflow.count++
+	overflow.queryTime.Add(float64(doc.Millis) * 1000)
+	overflow.bytesSent.Add(float64(doc.ResponseLength))
+	overflow.rowsSent.Add(float64(doc.Nreturned))
+	overflow.rowsExamined.Add(float64(doc.NscannedObjects))
+
+	// fingerprint doc the same way a tracked class would, so the sketch
+	// counts distinct query shapes rather than distinct literal queries
+	if fingerprint, err := self.fp.Fingerprint(doc.Query); err == nil {
+		overflow.fingerprints.Insert([]byte(fingerprint))
+	}
+	overflow.namespaces.Insert([]byte(doc.Ns))
+}
+
+// truncateDepthPlaceholder replaces any composite value nested at depth
+// maxDepth or deeper, so distinct queries differing only at or below that
+// depth still collapse into the same fingerprint.
+const truncateDepthPlaceholder = "..."
+
+// truncateDepth returns query with any bson.D/bson.M/array nested at depth
+// maxDepth or deeper collapsed into a placeholder, so the fingerprinter doesn't
+// treat deeply-nested-but-otherwise-identical queries as distinct classes.
+// query itself is depth 0, so its fields' values are depth 1: with maxDepth 1,
+// every composite field value of query is collapsed.
+func truncateDepth(query bson.D, maxDepth int) bson.D {
+	truncated := make(bson.D, len(query))
+	for i, elem := range query {
+		truncated[i] = bson.DocElem{Name: elem.Name, Value: truncateValueDepth(elem.Value, maxDepth-1)}
+	}
+
+	return truncated
+}
+
+// truncateValueDepth truncates v the same way truncateDepth does, recursing
+// into composite types; scalars are always returned as-is regardless of
+// depthRemaining, since there's nothing further to collapse within them.
+func truncateValueDepth(v interface{}, depthRemaining int) interface{} {
+	switch val := v.(type) {
+	case bson.D:
+		if depthRemaining <= 0 {
+			return truncateDepthPlaceholder
+		}
+		return truncateDepth(val, depthRemaining)
+	case bson.M:
+		if depthRemaining <= 0 {
+			return truncateDepthPlaceholder
+		}
+		truncated := make(bson.M, len(val))
+		for k, elem := range val {
+			truncated[k] = truncateValueDepth(elem, depthRemaining-1)
+		}
+		return truncated
+	case []interface{}:
+		if depthRemaining <= 0 {
+			return truncateDepthPlaceholder
+		}
+		truncated := make([]interface{}, len(val))
+		for i, elem := range val {
+			truncated[i] = truncateValueDepth(elem, depthRemaining-1)
+		}
+		return truncated
+	default:
+		return val
+	}
+}
+
+// rollOnAdd evicts any past interval whose TTL has elapsed by ts and, if ts
+// has moved past the current interval's end, archives the current interval
+// behind it rather than reporting it immediately, giving stragglers a chance
+// to still land in it. It returns anything that became ready to report.
+func (self *dbAggregator) rollOnAdd(ts time.Time) []pendingResult {
+	pending := self.evictExpired(ts)
+
+	if ts.Before(self.timeEnd) {
+		return pending
+	}
+
+	if len(self.stats.Queries()) > 0 || self.overflow.count > 0 {
+		self.past = append(self.past, &pastInterval{
+			timeStart: self.timeStart,
+			timeEnd:   self.timeEnd,
+			expiresAt: self.timeEnd.Add(self.hwMarkTTL),
+			stats:     self.stats,
+			overflow:  self.overflow,
+		})
+
+		// the ring only holds maxPast intervals; whatever falls off the front
+		// is reported now rather than silently dropped
+		if len(self.past) > self.maxPast {
+			evicted := self.past[0]
+			self.past = self.past[1:]
+			pending = append(pending, self.finalizePast(evicted))
+		}
+	}
+
+	self.newInterval(ts)
+
+	return pending
+}
+
+// evictExpired reports and removes any past interval whose hwMarkTTL has elapsed by ts
+func (self *dbAggregator) evictExpired(ts time.Time) []pendingResult {
+	var pending []pendingResult
+
+	kept := self.past[:0]
+	for _, p := range self.past {
+		if !ts.Before(p.expiresAt) {
+			pending = append(pending, self.finalizePast(p))
+			continue
+		}
+		kept = append(kept, p)
+	}
+	self.past = kept
+
+	return pending
+}
+
+func (self *dbAggregator) finalizePast(p *pastInterval) pendingResult {
+	return pendingResult{
+		result:    self.createResult(p.stats, p.overflow, int64(p.timeEnd.Sub(p.timeStart)/time.Second)),
+		timeStart: p.timeStart,
+		timeEnd:   p.timeEnd,
+	}
+}
+
+// report flushes every past interval that's still waiting out its TTL, plus
+// the current interval once ts has actually passed timeEnd; a current
+// interval that hasn't elapsed yet is left open so it keeps accumulating
+func (self *dbAggregator) report(ts time.Time) (*report.Result, time.Time, time.Time) {
+	var pending []pendingResult
+
+	for _, p := range self.past {
+		pending = append(pending, self.finalizePast(p))
+	}
+	self.past = nil
+
+	if !ts.Before(self.timeEnd) {
+		if len(self.stats.Queries()) > 0 || self.overflow.count > 0 {
+			pending = append(pending, pendingResult{
+				result:    self.createResult(self.stats, self.overflow, int64(self.D/time.Second)),
+				timeStart: self.timeStart,
+				timeEnd:   self.timeEnd,
+			})
+		}
+
+		self.newInterval(ts)
+	}
+
+	return mergeResults(pending)
+}
+
+func (self *dbAggregator) newInterval(ts time.Time) {
+	self.stats = stats.New(self.fp)
+	self.overflow = newOverflowBucket()
 
 	// truncate to the duration e.g 12:15:35 with 1 minute duration it will be 12:15:00
 	self.timeStart = ts.UTC().Truncate(self.D)
@@ -125,13 +791,19 @@ func (self *Aggregator) newInterval(ts time.Time) {
 	self.timeEnd = self.timeStart.Add(self.D)
 }
 
-func (self *Aggregator) createResult() *report.Result {
-	queries := self.stats.Queries()
+func (self *dbAggregator) createResult(st *stats.Stats, overflow overflowBucket, intervalSeconds int64) *report.Result {
+	buildStart := time.Now()
+	defer func() {
+		self.metrics.IntervalBuildSeconds.Observe(time.Since(buildStart).Seconds())
+	}()
+
+	queries := st.Queries()
 	global := event.NewClass("", "", false)
-	queryStats := queries.CalcQueriesStats(int64(self.config.Interval))
+	queryStats := queries.CalcQueriesStats(intervalSeconds)
 	classes := []*event.Class{}
 	for _, queryInfo := range queryStats {
-		class := event.NewClass(queryInfo.ID, queryInfo.Fingerprint, self.config.ExampleQueries)
+		fingerprint := applyReplacements(queryInfo.Fingerprint, self.replacements)
+		class := event.NewClass(queryInfo.ID, fingerprint, self.config.ExampleQueries)
 		if self.config.ExampleQueries {
 			db := ""
 			s := strings.SplitN(queryInfo.Namespace, ".", 2)
@@ -164,11 +836,30 @@ func (self *Aggregator) createResult() *report.Result {
 		global.AddClass(class)
 	}
 
+	if overflow.count > 0 {
+		class := event.NewClass(overflowID, overflowFingerprint, false)
+
+		metrics := event.NewMetrics()
+		metrics.TimeMetrics["Query_time"] = newEventTimeStatsInMilliseconds(overflow.queryTime.Statistics())
+		metrics.NumberMetrics["Bytes_sent"] = newEventNumberStats(overflow.bytesSent.Statistics())
+		metrics.NumberMetrics["Rows_sent"] = newEventNumberStats(overflow.rowsSent.Statistics())
+		metrics.NumberMetrics["Rows_examined"] = newEventNumberStats(overflow.rowsExamined.Statistics())
+		metrics.NumberMetrics["Unique_collections"] = newUniqueCountStat(overflow.namespaces.Estimate())
+
+		class.Metrics = metrics
+		class.TotalQueries = uint(overflow.count)
+		class.UniqueQueries = uint(overflow.fingerprints.Estimate())
+		classes = append(classes, class)
+
+		global.AddClass(class)
+	}
+
+	self.metrics.ReportClasses.Observe(float64(len(classes)))
+
 	return &report.Result{
 		Global: global,
 		Class:  classes,
 	}
-
 }
 
 func newEventNumberStats(s stats.Statistics) *event.NumberStats {
@@ -192,3 +883,16 @@ func newEventTimeStatsInMilliseconds(s stats.Statistics) *event.TimeStats {
 		Max: s.Max / 1000,
 	}
 }
+
+// newUniqueCountStat wraps a single cardinality estimate as a NumberStats so
+// it can ride in the same Metrics map as the other overflow-class counters.
+func newUniqueCountStat(v uint64) *event.NumberStats {
+	return &event.NumberStats{
+		Sum: v,
+		Min: v,
+		Avg: v,
+		Med: v,
+		P95: v,
+		Max: v,
+	}
+}
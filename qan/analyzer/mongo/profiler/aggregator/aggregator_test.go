@@ -0,0 +1,187 @@
+package aggregator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/percona/percona-toolkit/src/go/mongolib/fingerprinter"
+	"github.com/percona/percona-toolkit/src/go/mongolib/proto"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func testDoc(ns string, ts time.Time, value int) proto.SystemProfile {
+	return proto.SystemProfile{
+		Ts:              ts,
+		Ns:              ns,
+		Millis:          1,
+		ResponseLength:  100,
+		Nreturned:       1,
+		NscannedObjects: 1,
+		Query: bson.D{
+			{Name: "find", Value: "people"},
+			{Name: "filter", Value: bson.D{{Name: "age", Value: value}}},
+		},
+	}
+}
+
+func TestAddCollapsesFilteredKeyIntoOneClass(t *testing.T) {
+	fp := fingerprinter.NewFingerprinter([]string{"^age$"})
+	timeStart := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	agg := New(timeStart, Config{}, WithFingerprinter(fp))
+
+	// age is filtered out of the fingerprint by the key filter above, so these
+	// two docs should collapse into the same query class despite differing
+	// values.
+	_, err := agg.Add(testDoc("test.people", timeStart.Add(time.Second), 18))
+	require.NoError(t, err)
+	_, err = agg.Add(testDoc("test.people", timeStart.Add(2*time.Second), 42))
+	require.NoError(t, err)
+
+	db := agg.dbs["test"]
+	require.NotNil(t, db)
+	require.Len(t, db.stats.Queries(), 1)
+}
+
+func TestAddOnlyOverflowsGenuinelyNewClasses(t *testing.T) {
+	fp := fingerprinter.NewFingerprinter(fingerprinter.DEFAULT_KEY_FILTERS)
+	timeStart := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := Config{MaxGroups: 1}
+	agg := New(timeStart, config, WithFingerprinter(fp))
+
+	_, err := agg.Add(testDoc("test.people", timeStart.Add(time.Second), 1))
+	require.NoError(t, err)
+
+	db := agg.dbs["test"]
+	require.Len(t, db.stats.Queries(), 1)
+
+	// a doc matching the already-tracked class should keep updating it
+	// rather than overflow, even though we're at MaxGroups.
+	_, err = agg.Add(testDoc("test.people", timeStart.Add(2*time.Second), 1))
+	require.NoError(t, err)
+	require.Len(t, db.stats.Queries(), 1)
+	require.Equal(t, uint64(0), db.overflow.count)
+
+	// a doc with a genuinely different fingerprint should fold into overflow
+	// instead of growing past MaxGroups.
+	other := testDoc("test.people", timeStart.Add(3*time.Second), 1)
+	other.Query = bson.D{{Name: "count", Value: "people"}}
+	_, err = agg.Add(other)
+	require.NoError(t, err)
+	require.Len(t, db.stats.Queries(), 1)
+	require.Equal(t, uint64(1), db.overflow.count)
+}
+
+func TestPerDatabaseIntervalRouting(t *testing.T) {
+	fp := fingerprinter.NewFingerprinter(fingerprinter.DEFAULT_KEY_FILTERS)
+	timeStart := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := Config{
+		PerDatabaseInterval: map[string]int{"slowdb": 300},
+	}
+	config.Interval = 60
+	agg := New(timeStart, config, WithFingerprinter(fp))
+
+	_, err := agg.Add(testDoc("fastdb.people", timeStart.Add(time.Second), 1))
+	require.NoError(t, err)
+	_, err = agg.Add(testDoc("slowdb.people", timeStart.Add(time.Second), 1))
+	require.NoError(t, err)
+
+	require.Len(t, agg.dbs, 2)
+	require.Equal(t, 60*time.Second, agg.dbs["fastdb"].D)
+	require.Equal(t, 300*time.Second, agg.dbs["slowdb"].D)
+}
+
+func TestLateArrivalLandsInPastInterval(t *testing.T) {
+	fp := fingerprinter.NewFingerprinter(fingerprinter.DEFAULT_KEY_FILTERS)
+	timeStart := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := Config{PastIntervals: 2}
+	config.Interval = 60
+	agg := New(timeStart, config, WithFingerprinter(fp))
+
+	_, err := agg.Add(testDoc("test.people", timeStart.Add(time.Second), 1))
+	require.NoError(t, err)
+
+	db := agg.dbs["test"]
+	require.NotNil(t, db)
+
+	// roll into the next interval so the first one becomes a past interval.
+	_, err = agg.Add(testDoc("test.people", timeStart.Add(61*time.Second), 1))
+	require.NoError(t, err)
+	require.Len(t, db.past, 1)
+
+	// a doc timestamped back in the now-past interval should land there
+	// rather than being dropped.
+	_, err = agg.Add(testDoc("test.people", timeStart.Add(30*time.Second), 1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), db.droppedTooOld)
+	require.Len(t, db.past[0].stats.Queries(), 1)
+
+	// a doc older than every tracked interval has nowhere to land and is
+	// dropped.
+	_, err = agg.Add(testDoc("test.people", timeStart.Add(-time.Hour), 1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), db.droppedTooOld)
+}
+
+func TestPastIntervalAlsoOverflowsBeyondMaxGroups(t *testing.T) {
+	fp := fingerprinter.NewFingerprinter(fingerprinter.DEFAULT_KEY_FILTERS)
+	timeStart := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := Config{MaxGroups: 1, PastIntervals: 2}
+	config.Interval = 60
+	agg := New(timeStart, config, WithFingerprinter(fp))
+
+	// fill the first interval's one class, then roll it into the past ring.
+	_, err := agg.Add(testDoc("test.people", timeStart.Add(time.Second), 1))
+	require.NoError(t, err)
+	_, err = agg.Add(testDoc("test.people", timeStart.Add(61*time.Second), 1))
+	require.NoError(t, err)
+
+	db := agg.dbs["test"]
+	require.Len(t, db.past, 1)
+	require.Len(t, db.past[0].stats.Queries(), 1)
+
+	// a late doc matching the past interval's already-tracked class should
+	// keep updating it.
+	_, err = agg.Add(testDoc("test.people", timeStart.Add(30*time.Second), 1))
+	require.NoError(t, err)
+	require.Len(t, db.past[0].stats.Queries(), 1)
+	require.Equal(t, uint64(0), db.past[0].overflow.count)
+
+	// a late doc with a genuinely new fingerprint should overflow within the
+	// past interval rather than growing its class map past MaxGroups.
+	other := testDoc("test.people", timeStart.Add(31*time.Second), 1)
+	other.Query = bson.D{{Name: "count", Value: "people"}}
+	_, err = agg.Add(other)
+	require.NoError(t, err)
+	require.Len(t, db.past[0].stats.Queries(), 1)
+	require.Equal(t, uint64(1), db.past[0].overflow.count)
+}
+
+func TestAddTruncatesQueryDepthBeforeFingerprinting(t *testing.T) {
+	fp := fingerprinter.NewFingerprinter(fingerprinter.DEFAULT_KEY_FILTERS)
+	timeStart := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := Config{Fingerprint: FingerprintConfig{MaxDepth: 1}}
+	agg := New(timeStart, config, WithFingerprinter(fp))
+
+	// filter differs only below MaxDepth, so both docs should collapse into
+	// the same query class once the nested filter is truncated away.
+	first := testDoc("test.people", timeStart.Add(time.Second), 18)
+	first.Query = bson.D{
+		{Name: "find", Value: "people"},
+		{Name: "filter", Value: bson.D{{Name: "age", Value: bson.D{{Name: "$gt", Value: 18}}}}},
+	}
+	second := testDoc("test.people", timeStart.Add(2*time.Second), 42)
+	second.Query = bson.D{
+		{Name: "find", Value: "people"},
+		{Name: "filter", Value: bson.D{{Name: "age", Value: bson.D{{Name: "$gt", Value: 42}}}}},
+	}
+
+	_, err := agg.Add(first)
+	require.NoError(t, err)
+	_, err = agg.Add(second)
+	require.NoError(t, err)
+
+	db := agg.dbs["test"]
+	require.NotNil(t, db)
+	require.Len(t, db.stats.Queries(), 1)
+}